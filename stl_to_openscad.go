@@ -22,6 +22,7 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -38,8 +40,19 @@ var (
 	outputFilenameFlag = flag.String("output", "", "The output file to write to. If not set, the program writes to stdout")
 	moduleNameFlag     = flag.String("module", "", "Name of the generated OpenSCAD module")
 	centerFlag         = flag.Bool("center", true, "If true, the shape is centered in the (x,y) plane")
+	weldFlag           = flag.Float64("weld", 1e-6, "Tolerance used to weld coincident vertices into a shared index")
+	modeFlag           = flag.String("mode", "polyhedron", "Output mode: \"polyhedron\" (default) or \"contours\" (slice the mesh into a stack of linear_extrude'd cross-sections, see -z)")
+	zFlag              = flag.String("z", "", "Comma-separated list of Z heights, used with -mode=contours: each layer is sliced at one value and extruded up to the next, so the last value only sets the top of the last layer")
+	cacheFlag          = flag.String("cache", "", "Path to a compact binary mesh cache. If it exists and was built with the same -weld, -center and input file, the welded mesh is loaded from it, skipping the STL parse; otherwise it is (re)written after parsing")
+	clipFlag           = flag.String("clip", "", "Path to a 2D clip polygon (one \"x y\" vertex per line, in either winding order). Triangles outside it are dropped, straddling triangles are re-triangulated at the boundary")
+	bboxFlag           = flag.String("bbox", "", "xmin,ymin,xmax,ymax: export only the triangles whose 2D bounding box overlaps this rectangle")
+	repairFlag         = flag.Bool("repair", false, "Drop degenerate facets, report non-manifold/boundary edges, and make triangle winding consistent")
 
 	moduleName string
+	// shapeName is the name from the STL's "solid <name>" header (empty for
+	// binary STL input), independent of any -module override, so it can be
+	// persisted in a mesh cache and recovered on a cache hit.
+	shapeName string
 )
 
 type point struct {
@@ -76,6 +89,803 @@ func (polygons polygons) boundingBox() (min, max point) {
 	return min, max
 }
 
+// mesh is a welded representation of a set of triangles: vertices are
+// deduplicated into a shared table, and faces reference that table by
+// index, mirroring the Vertices/Triangles layout used by TIN meshes.
+type mesh struct {
+	vertices []point
+	faces    [][3]int32
+}
+
+// weldKey quantizes a point to a grid of the given size: points whose
+// coordinates round to the same multiples of weld map to the same key.
+// Two points closer than weld can still round to neighbouring cells and
+// get different keys.
+func weldKey(p point, weld float64) [3]int64 {
+	scale := 1 / weld
+	return [3]int64{
+		int64(math.Round(float64(p.x) * scale)),
+		int64(math.Round(float64(p.y) * scale)),
+		int64(math.Round(float64(p.z) * scale)),
+	}
+}
+
+// buildMesh welds the vertices of polygons into a shared index, within
+// the given tolerance, and rewrites each triangle as indices into that
+// table.
+func buildMesh(polygons polygons, weld float64) mesh {
+	var m mesh
+	index := make(map[[3]int64]int32)
+
+	vertexIndex := func(p point) int32 {
+		k := weldKey(p, weld)
+		if idx, ok := index[k]; ok {
+			return idx
+		}
+		idx := int32(len(m.vertices))
+		m.vertices = append(m.vertices, p)
+		index[k] = idx
+		return idx
+	}
+
+	for _, p := range polygons {
+		var face [3]int32
+		for i, v := range p.vertices {
+			face[i] = vertexIndex(v)
+		}
+		m.faces = append(m.faces, face)
+	}
+
+	return m
+}
+
+// strNodeSize is the branching factor (M) of the STR-tree: the number of
+// items or child nodes packed under each node.
+const strNodeSize = 16
+
+// strTree is a Sort-Tile-Recursive bounding-box index over a mesh's
+// triangles. It is built bottom-up: triangles are sorted into
+// ceil(sqrt(n/M)) vertical slices by X, each slice is sorted by Y, and
+// consecutive runs of M triangles become the leaves; parents are packed
+// the same way, M nodes at a time, until a single root remains. Nodes of
+// every level are stored back to back in bboxes/levelBounds so the tree
+// can be queried without ever materializing child pointers.
+type strTree struct {
+	nodeSize    int
+	numItems    int
+	levelBounds []int     // cumulative node count after each level, leaves first
+	index       []int32   // triangle index for each leaf, in STR-sorted order
+	bboxes      []float64 // 6 floats (xmin,ymin,zmin,xmax,ymax,zmax) per node, all levels concatenated
+}
+
+func triangleBBox3D(v0, v1, v2 point) (xmin, ymin, zmin, xmax, ymax, zmax float64) {
+	xmin = math.Min(float64(v0.x), math.Min(float64(v1.x), float64(v2.x)))
+	xmax = math.Max(float64(v0.x), math.Max(float64(v1.x), float64(v2.x)))
+	ymin = math.Min(float64(v0.y), math.Min(float64(v1.y), float64(v2.y)))
+	ymax = math.Max(float64(v0.y), math.Max(float64(v1.y), float64(v2.y)))
+	zmin = math.Min(float64(v0.z), math.Min(float64(v1.z), float64(v2.z)))
+	zmax = math.Max(float64(v0.z), math.Max(float64(v1.z), float64(v2.z)))
+	return xmin, ymin, zmin, xmax, ymax, zmax
+}
+
+// buildSTRTree packs an STR-tree over every triangle of m. Each node's
+// bbox spans x, y and z, so the same tree accelerates both XY-rectangle
+// queries (-clip, -bbox) and Z-plane queries (-mode=contours).
+func buildSTRTree(m mesh) *strTree {
+	n := len(m.faces)
+	t := &strTree{nodeSize: strNodeSize, numItems: n}
+	if n == 0 {
+		return t
+	}
+
+	type item struct {
+		idx                                int32
+		xmin, ymin, zmin, xmax, ymax, zmax float64
+	}
+	items := make([]item, n)
+	for i, f := range m.faces {
+		xmin, ymin, zmin, xmax, ymax, zmax := triangleBBox3D(m.vertices[f[0]], m.vertices[f[1]], m.vertices[f[2]])
+		items[i] = item{int32(i), xmin, ymin, zmin, xmax, ymax, zmax}
+	}
+
+	numSlices := int(math.Ceil(math.Sqrt(float64(n) / float64(t.nodeSize))))
+	if numSlices < 1 {
+		numSlices = 1
+	}
+	sliceSize := int(math.Ceil(float64(n) / float64(numSlices)))
+
+	sort.Slice(items, func(i, j int) bool { return items[i].xmin < items[j].xmin })
+	for s := 0; s < n; s += sliceSize {
+		e := s + sliceSize
+		if e > n {
+			e = n
+		}
+		slice := items[s:e]
+		sort.Slice(slice, func(i, j int) bool { return slice[i].ymin < slice[j].ymin })
+	}
+
+	t.index = make([]int32, n)
+	levelBoxes := make([]float64, 6*n)
+	for i, it := range items {
+		t.index[i] = it.idx
+		levelBoxes[6*i+0] = it.xmin
+		levelBoxes[6*i+1] = it.ymin
+		levelBoxes[6*i+2] = it.zmin
+		levelBoxes[6*i+3] = it.xmax
+		levelBoxes[6*i+4] = it.ymax
+		levelBoxes[6*i+5] = it.zmax
+	}
+	t.bboxes = append(t.bboxes, levelBoxes...)
+	t.levelBounds = append(t.levelBounds, n)
+
+	levelCount := n
+	levelStart := 0
+	for levelCount > 1 {
+		parentCount := int(math.Ceil(float64(levelCount) / float64(t.nodeSize)))
+		parentBoxes := make([]float64, 6*parentCount)
+		for p := 0; p < parentCount; p++ {
+			cs := p * t.nodeSize
+			ce := cs + t.nodeSize
+			if ce > levelCount {
+				ce = levelCount
+			}
+			xmin, ymin, zmin := math.MaxFloat64, math.MaxFloat64, math.MaxFloat64
+			xmax, ymax, zmax := -math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64
+			for c := cs; c < ce; c++ {
+				base := 6 * (levelStart + c)
+				xmin = math.Min(xmin, t.bboxes[base+0])
+				ymin = math.Min(ymin, t.bboxes[base+1])
+				zmin = math.Min(zmin, t.bboxes[base+2])
+				xmax = math.Max(xmax, t.bboxes[base+3])
+				ymax = math.Max(ymax, t.bboxes[base+4])
+				zmax = math.Max(zmax, t.bboxes[base+5])
+			}
+			parentBoxes[6*p+0], parentBoxes[6*p+1], parentBoxes[6*p+2] = xmin, ymin, zmin
+			parentBoxes[6*p+3], parentBoxes[6*p+4], parentBoxes[6*p+5] = xmax, ymax, zmax
+		}
+		levelStart += levelCount
+		t.bboxes = append(t.bboxes, parentBoxes...)
+		t.levelBounds = append(t.levelBounds, levelStart+parentCount)
+		levelCount = parentCount
+	}
+
+	return t
+}
+
+// query returns the indices (into the mesh's faces) of every triangle
+// whose 3D bounding box overlaps [xmin,ymin,zmin]-[xmax,ymax,zmax],
+// descending only into nodes whose own bbox overlaps the query box.
+func (t *strTree) query(xmin, ymin, zmin, xmax, ymax, zmax float64) []int32 {
+	if t.numItems == 0 {
+		return nil
+	}
+
+	levelStart := make([]int, len(t.levelBounds))
+	start := 0
+	for l := range t.levelBounds {
+		levelStart[l] = start
+		start = t.levelBounds[l]
+	}
+
+	type stackEntry struct {
+		level, pos int
+	}
+	var result []int32
+	stack := []stackEntry{{len(t.levelBounds) - 1, 0}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		base := 6 * (levelStart[e.level] + e.pos)
+		if t.bboxes[base+3] < xmin || t.bboxes[base+0] > xmax ||
+			t.bboxes[base+4] < ymin || t.bboxes[base+1] > ymax ||
+			t.bboxes[base+5] < zmin || t.bboxes[base+2] > zmax {
+			continue
+		}
+
+		if e.level == 0 {
+			result = append(result, t.index[e.pos])
+			continue
+		}
+
+		childLevel := e.level - 1
+		childLevelLen := t.levelBounds[childLevel] - levelStart[childLevel]
+		cs := e.pos * t.nodeSize
+		ce := cs + t.nodeSize
+		if ce > childLevelLen {
+			ce = childLevelLen
+		}
+		for c := cs; c < ce; c++ {
+			stack = append(stack, stackEntry{childLevel, c})
+		}
+	}
+	return result
+}
+
+// queryXY returns triangles whose XY footprint overlaps the given
+// rectangle, at any Z.
+func (t *strTree) queryXY(xmin, ymin, xmax, ymax float64) []int32 {
+	return t.query(xmin, ymin, math.Inf(-1), xmax, ymax, math.Inf(1))
+}
+
+// queryZ returns triangles whose Z range includes level, at any X/Y.
+func (t *strTree) queryZ(level float64) []int32 {
+	return t.query(math.Inf(-1), math.Inf(-1), level, math.Inf(1), math.Inf(1), level)
+}
+
+func polygonBBox(poly []point) (xmin, ymin, xmax, ymax float64) {
+	xmin, ymin = math.MaxFloat64, math.MaxFloat64
+	xmax, ymax = -math.MaxFloat64, -math.MaxFloat64
+	for _, p := range poly {
+		xmin = math.Min(xmin, float64(p.x))
+		ymin = math.Min(ymin, float64(p.y))
+		xmax = math.Max(xmax, float64(p.x))
+		ymax = math.Max(ymax, float64(p.y))
+	}
+	return xmin, ymin, xmax, ymax
+}
+
+func parseBBox(s string) (xmin, ymin, xmax, ymax float64) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		log.Fatalf("-bbox must have the form xmin,ymin,xmax,ymax, got %q", s)
+	}
+	vals := make([]float64, 4)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			log.Fatalf("Can't parse -bbox value %q: %s", p, err)
+		}
+		vals[i] = v
+	}
+	return vals[0], vals[1], vals[2], vals[3]
+}
+
+// exportBBox returns the subset of m whose triangles' XY bounding boxes
+// overlap the query rectangle, found via tree instead of scanning every
+// triangle.
+func exportBBox(m mesh, tree *strTree, xmin, ymin, xmax, ymax float64) mesh {
+	var out mesh
+	remap := make(map[int32]int32)
+	vertexIndex := func(orig int32) int32 {
+		if idx, ok := remap[orig]; ok {
+			return idx
+		}
+		idx := int32(len(out.vertices))
+		out.vertices = append(out.vertices, m.vertices[orig])
+		remap[orig] = idx
+		return idx
+	}
+	for _, ti := range tree.queryXY(xmin, ymin, xmax, ymax) {
+		f := m.faces[ti]
+		out.faces = append(out.faces, [3]int32{vertexIndex(f[0]), vertexIndex(f[1]), vertexIndex(f[2])})
+	}
+	return out
+}
+
+// meshCacheMagic identifies a cache file written by writeMeshCache.
+const meshCacheMagic = uint32(0x4d455348) // "MESH"
+
+// meshCacheHeader records the inputs a cache was built from, so a stale
+// cache (different -weld, a different -center, or a source STL that has
+// since changed) can be detected and refused instead of silently reused.
+// shapeName is not a staleness key - it's just the "solid <name>" header
+// the source STL was parsed with (empty for binary STL input), persisted
+// so a cache hit can still derive the module name without a full parse.
+type meshCacheHeader struct {
+	weld          float64
+	center        bool
+	sourceSize    int64
+	sourceModTime int64
+	shapeName     string
+}
+
+// writeMeshCache serializes a welded mesh to path as gzip-compressed,
+// little-endian binary: meshCacheMagic, the header fields (weld, center,
+// source size, source mtime, then the shape name as a length-prefixed
+// string), vertex count, float32 xyz triples, triangle count, then varint
+// deltas of the vertex indices making up each face.
+func writeMeshCache(path string, m mesh, header meshCacheHeader) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Can't create cache file %q: %s", path, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	if err != nil {
+		log.Fatalf("Can't create gzip writer for %q: %s", path, err)
+	}
+	w := bufio.NewWriter(gz)
+
+	binary.Write(w, binary.LittleEndian, meshCacheMagic)
+	binary.Write(w, binary.LittleEndian, header.weld)
+	binary.Write(w, binary.LittleEndian, header.center)
+	binary.Write(w, binary.LittleEndian, header.sourceSize)
+	binary.Write(w, binary.LittleEndian, header.sourceModTime)
+	binary.Write(w, binary.LittleEndian, uint32(len(header.shapeName)))
+	w.WriteString(header.shapeName)
+
+	binary.Write(w, binary.LittleEndian, uint32(len(m.vertices)))
+	for _, v := range m.vertices {
+		binary.Write(w, binary.LittleEndian, v.x)
+		binary.Write(w, binary.LittleEndian, v.y)
+		binary.Write(w, binary.LittleEndian, v.z)
+	}
+
+	binary.Write(w, binary.LittleEndian, uint32(len(m.faces)))
+	var varintBuf [binary.MaxVarintLen64]byte
+	prev := int64(0)
+	for _, face := range m.faces {
+		for _, idx := range face {
+			n := binary.PutVarint(varintBuf[:], int64(idx)-prev)
+			w.Write(varintBuf[:n])
+			prev = int64(idx)
+		}
+	}
+
+	w.Flush()
+	if err := gz.Close(); err != nil {
+		log.Fatalf("Can't flush cache file %q: %s", path, err)
+	}
+}
+
+// readMeshCache deserializes a mesh previously written by writeMeshCache,
+// but only if its header was built with the same weld tolerance, the same
+// -center setting, and (when known) the same source file size/mtime as
+// want; otherwise it logs why and returns ok=false, leaving the caller to
+// fall back to re-parsing. On success, header is the cache's own header
+// (notably its shapeName), so the caller can still recover the module
+// name that readAscii would otherwise have derived.
+func readMeshCache(path string, want meshCacheHeader) (m mesh, header meshCacheHeader, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Can't open cache file %q: %s", path, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatalf("Can't read cache file %q: %s", path, err)
+	}
+	defer gz.Close()
+	r := bufio.NewReader(gz)
+
+	var magic uint32
+	binary.Read(r, binary.LittleEndian, &magic)
+	binary.Read(r, binary.LittleEndian, &header.weld)
+	binary.Read(r, binary.LittleEndian, &header.center)
+	binary.Read(r, binary.LittleEndian, &header.sourceSize)
+	binary.Read(r, binary.LittleEndian, &header.sourceModTime)
+	var nameLen uint32
+	binary.Read(r, binary.LittleEndian, &nameLen)
+	nameBuf := make([]byte, nameLen)
+	io.ReadFull(r, nameBuf)
+	header.shapeName = string(nameBuf)
+
+	if magic != meshCacheMagic {
+		log.Printf("Cache %q has an unrecognized header, ignoring", path)
+		return mesh{}, meshCacheHeader{}, false
+	}
+	if header.weld != want.weld {
+		log.Printf("Cache %q was built with -weld=%g, not %g; ignoring", path, header.weld, want.weld)
+		return mesh{}, meshCacheHeader{}, false
+	}
+	if header.center != want.center {
+		log.Printf("Cache %q was built with -center=%t, not %t; ignoring", path, header.center, want.center)
+		return mesh{}, meshCacheHeader{}, false
+	}
+	if want.sourceSize != 0 && (header.sourceSize != want.sourceSize || header.sourceModTime != want.sourceModTime) {
+		log.Printf("Cache %q is stale for the current input file, ignoring", path)
+		return mesh{}, meshCacheHeader{}, false
+	}
+
+	var numVertices uint32
+	binary.Read(r, binary.LittleEndian, &numVertices)
+	for i := uint32(0); i < numVertices; i++ {
+		var p point
+		binary.Read(r, binary.LittleEndian, &p.x)
+		binary.Read(r, binary.LittleEndian, &p.y)
+		binary.Read(r, binary.LittleEndian, &p.z)
+		m.vertices = append(m.vertices, p)
+	}
+
+	var numTriangles uint32
+	binary.Read(r, binary.LittleEndian, &numTriangles)
+	prev := int64(0)
+	for i := uint32(0); i < numTriangles; i++ {
+		var face [3]int32
+		for j := 0; j < 3; j++ {
+			delta, err := binary.ReadVarint(r)
+			if err != nil {
+				log.Fatalf("Can't read cache file %q: %s", path, err)
+			}
+			prev += delta
+			face[j] = int32(prev)
+		}
+		m.faces = append(m.faces, face)
+	}
+
+	return m, header, true
+}
+
+// segment is one piece of a contour line, produced by slicing a single
+// triangle at a Z plane.
+type segment struct {
+	a, b point
+}
+
+// sliceMesh intersects every triangle of m with the plane z=level and
+// stitches the resulting segments into closed rings.
+// sliceMesh uses tree to skip triangles whose Z range doesn't straddle
+// level instead of scanning every triangle in the mesh.
+func sliceMesh(m mesh, level float32, weld float64, tree *strTree) [][]point {
+	interp := func(a, b point, da, db float32) point {
+		t := da / (da - db)
+		return point{
+			x: a.x + t*(b.x-a.x),
+			y: a.y + t*(b.y-a.y),
+			z: level,
+		}
+	}
+
+	var segments []segment
+	for _, fi := range tree.queryZ(float64(level)) {
+		f := m.faces[fi]
+		v := [3]point{m.vertices[f[0]], m.vertices[f[1]], m.vertices[f[2]]}
+		d := [3]float32{v[0].z - level, v[1].z - level, v[2].z - level}
+
+		var pts []point
+		for i := 0; i < 3; i++ {
+			j := (i + 1) % 3
+			if (d[i] < 0) != (d[j] < 0) {
+				pts = append(pts, interp(v[i], v[j], d[i], d[j]))
+			}
+		}
+		if len(pts) == 2 {
+			segments = append(segments, segment{pts[0], pts[1]})
+		}
+	}
+
+	return stitchRings(segments, weld)
+}
+
+// stitchRings walks the given segments, hashing their endpoints with the
+// weld tolerance, and chains them into closed rings.
+func stitchRings(segments []segment, weld float64) [][]point {
+	type endpoint struct {
+		segIdx int
+		atB    bool
+	}
+	adjacency := make(map[[3]int64][]endpoint)
+	for i, s := range segments {
+		adjacency[weldKey(s.a, weld)] = append(adjacency[weldKey(s.a, weld)], endpoint{i, false})
+		adjacency[weldKey(s.b, weld)] = append(adjacency[weldKey(s.b, weld)], endpoint{i, true})
+	}
+
+	used := make([]bool, len(segments))
+	var rings [][]point
+	for start := range segments {
+		if used[start] {
+			continue
+		}
+		ring := []point{segments[start].a}
+		cur := start
+		for {
+			used[cur] = true
+			ring = append(ring, segments[cur].b)
+
+			next := -1
+			for _, e := range adjacency[weldKey(segments[cur].b, weld)] {
+				if used[e.segIdx] {
+					continue
+				}
+				next = e.segIdx
+				if e.atB {
+					segments[next].a, segments[next].b = segments[next].b, segments[next].a
+				}
+				break
+			}
+			if next == -1 {
+				break
+			}
+			cur = next
+		}
+		// A closed ring's last point welds back onto its first; drop the
+		// duplicate so the ring has no redundant zero-length edge.
+		if len(ring) > 1 && weldKey(ring[0], weld) == weldKey(ring[len(ring)-1], weld) {
+			ring = ring[:len(ring)-1]
+		}
+		rings = append(rings, ring)
+	}
+	return rings
+}
+
+// signedArea computes the shoelace area of a closed ring in the XY plane.
+// Counter-clockwise rings come out positive, clockwise rings negative.
+func signedArea(ring []point) float64 {
+	var sum float64
+	n := len(ring)
+	for i := 0; i < n; i++ {
+		j := (i + 1) % n
+		sum += float64(ring[i].x)*float64(ring[j].y) - float64(ring[j].x)*float64(ring[i].y)
+	}
+	return sum / 2
+}
+
+// readClipPolygon reads a 2D clip polygon from path, one "x y" vertex per
+// line, and normalizes it to counter-clockwise winding.
+func readClipPolygon(path string) []point {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Can't open clip file %q: %s", path, err)
+	}
+	defer f.Close()
+
+	var poly []point
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			log.Fatalf("Invalid clip polygon line %q in %q", line, path)
+		}
+		x, err := strconv.ParseFloat(fields[0], 32)
+		if err != nil {
+			log.Fatalf("Can't parse x in clip polygon line %q: %s", line, err)
+		}
+		y, err := strconv.ParseFloat(fields[1], 32)
+		if err != nil {
+			log.Fatalf("Can't parse y in clip polygon line %q: %s", line, err)
+		}
+		poly = append(poly, point{x: float32(x), y: float32(y)})
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error reading clip file %q: %s", path, err)
+	}
+	if signedArea(poly) < 0 {
+		for i, j := 0, len(poly)-1; i < j; i, j = i+1, j-1 {
+			poly[i], poly[j] = poly[j], poly[i]
+		}
+	}
+	return poly
+}
+
+// isInsideEdge reports whether p lies on the inside (left) of the
+// directed edge a->b of a counter-clockwise polygon.
+func isInsideEdge(p, a, b point) bool {
+	return float64(b.x-a.x)*float64(p.y-a.y)-float64(b.y-a.y)*float64(p.x-a.x) >= 0
+}
+
+// lineIntersect2D returns the intersection of line p1-p2 with line a-b,
+// ignoring z.
+func lineIntersect2D(p1, p2, a, b point) point {
+	x1, y1 := float64(p1.x), float64(p1.y)
+	x2, y2 := float64(p2.x), float64(p2.y)
+	x3, y3 := float64(a.x), float64(a.y)
+	x4, y4 := float64(b.x), float64(b.y)
+
+	denom := (x1-x2)*(y3-y4) - (y1-y2)*(x3-x4)
+	t := ((x1-x3)*(y3-y4) - (y1-y3)*(x3-x4)) / denom
+	return point{
+		x: float32(x1 + t*(x2-x1)),
+		y: float32(y1 + t*(y2-y1)),
+	}
+}
+
+// clipPolygon clips subject against the convex polygon clip using
+// Sutherland-Hodgman. z is ignored and left zero on new vertices; callers
+// that need z must re-interpolate it afterwards.
+func clipPolygon(subject, clip []point) []point {
+	output := subject
+	for i := 0; i < len(clip) && len(output) > 0; i++ {
+		a, b := clip[i], clip[(i+1)%len(clip)]
+		input := output
+		output = nil
+		for j, cur := range input {
+			prev := input[(j-1+len(input))%len(input)]
+			curIn := isInsideEdge(cur, a, b)
+			prevIn := isInsideEdge(prev, a, b)
+			if curIn {
+				if !prevIn {
+					output = append(output, lineIntersect2D(prev, cur, a, b))
+				}
+				output = append(output, cur)
+			} else if prevIn {
+				output = append(output, lineIntersect2D(prev, cur, a, b))
+			}
+		}
+	}
+	return output
+}
+
+// barycentric2D returns the barycentric weights of p with respect to
+// triangle (a, b, c), using only their x/y coordinates.
+func barycentric2D(p, a, b, c point) (wa, wb, wc float64) {
+	det := float64(b.y-c.y)*float64(a.x-c.x) + float64(c.x-b.x)*float64(a.y-c.y)
+	if det == 0 {
+		return 1, 0, 0
+	}
+	wa = (float64(b.y-c.y)*float64(p.x-c.x) + float64(c.x-b.x)*float64(p.y-c.y)) / det
+	wb = (float64(c.y-a.y)*float64(p.x-c.x) + float64(a.x-c.x)*float64(p.y-c.y)) / det
+	wc = 1 - wa - wb
+	return wa, wb, wc
+}
+
+// cross2D returns the z-component of (b-a) x (c-a), ignoring z.
+func cross2D(a, b, c point) float64 {
+	return float64(b.x-a.x)*float64(c.y-a.y) - float64(b.y-a.y)*float64(c.x-a.x)
+}
+
+// isConvexPolygon reports whether poly is convex, assuming it is simple
+// (non-self-intersecting). Collinear vertices (zero cross product) are
+// allowed and don't affect the turning direction.
+func isConvexPolygon(poly []point) bool {
+	n := len(poly)
+	if n < 4 {
+		return true
+	}
+	sign := 0
+	for i := 0; i < n; i++ {
+		a := poly[i]
+		b := poly[(i+1)%n]
+		c := poly[(i+2)%n]
+		cr := cross2D(a, b, c)
+		if cr == 0 {
+			continue
+		}
+		want := 1
+		if cr < 0 {
+			want = -1
+		}
+		if sign == 0 {
+			sign = want
+		} else if sign != want {
+			return false
+		}
+	}
+	return true
+}
+
+// pointInTriangle reports whether p lies inside or on the boundary of
+// triangle (a, b, c), using only x/y.
+func pointInTriangle(p, a, b, c point) bool {
+	d1 := cross2D(a, b, p)
+	d2 := cross2D(b, c, p)
+	d3 := cross2D(c, a, p)
+	hasNeg := d1 < 0 || d2 < 0 || d3 < 0
+	hasPos := d1 > 0 || d2 > 0 || d3 > 0
+	return !(hasNeg && hasPos)
+}
+
+// triangulateEarClip decomposes a simple, counter-clockwise polygon into
+// convex (triangular) pieces via ear clipping, so that clipPolygon -
+// which only handles convex clip polygons - can be applied to each piece
+// in turn.
+func triangulateEarClip(poly []point) [][]point {
+	n := len(poly)
+	if n < 3 {
+		return nil
+	}
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+
+	var triangles [][]point
+	for len(idx) > 3 {
+		earFound := false
+		for i := range idx {
+			prev := idx[(i-1+len(idx))%len(idx)]
+			cur := idx[i]
+			next := idx[(i+1)%len(idx)]
+			a, b, c := poly[prev], poly[cur], poly[next]
+			if cross2D(a, b, c) <= 0 {
+				continue
+			}
+			isEar := true
+			for _, j := range idx {
+				if j == prev || j == cur || j == next {
+					continue
+				}
+				if pointInTriangle(poly[j], a, b, c) {
+					isEar = false
+					break
+				}
+			}
+			if !isEar {
+				continue
+			}
+			triangles = append(triangles, []point{a, b, c})
+			idx = append(idx[:i], idx[i+1:]...)
+			earFound = true
+			break
+		}
+		if !earFound {
+			// Degenerate or self-intersecting polygon: bail out rather
+			// than spin forever; the caller gets the pieces found so far.
+			break
+		}
+	}
+	if len(idx) == 3 {
+		triangles = append(triangles, []point{poly[idx[0]], poly[idx[1]], poly[idx[2]]})
+	}
+	return triangles
+}
+
+// clipPieces decomposes poly into one or more convex pieces suitable for
+// clipPolygon. Already-convex polygons (the common case) are returned
+// unchanged; non-convex polygons are ear-clipped into triangles and the
+// clipped mesh is the union of clipping against each piece.
+func clipPieces(poly []point) [][]point {
+	if isConvexPolygon(poly) {
+		return [][]point{poly}
+	}
+	return triangulateEarClip(poly)
+}
+
+// clipMesh clips every triangle of m against the convex clip pieces,
+// re-triangulating straddling triangles by fanning from the first vertex
+// of each clipped piece and interpolating z from the original triangle's
+// plane equation, then re-welds the result. tree is used to skip
+// triangles whose bbox can't possibly overlap any piece instead of
+// scanning the whole mesh. Non-convex clip polygons are handled by
+// passing multiple pieces (see clipPieces); since the pieces tile the
+// original polygon without overlap, clipping each candidate triangle
+// against every piece and welding the non-empty results together is
+// equivalent to clipping against the original non-convex polygon.
+func clipMesh(m mesh, pieces [][]point, weld float64, tree *strTree) mesh {
+	var out mesh
+	index := make(map[[3]int64]int32)
+	vertexIndex := func(p point) int32 {
+		k := weldKey(p, weld)
+		if idx, ok := index[k]; ok {
+			return idx
+		}
+		idx := int32(len(out.vertices))
+		out.vertices = append(out.vertices, p)
+		index[k] = idx
+		return idx
+	}
+
+	xmin, ymin, xmax, ymax := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, piece := range pieces {
+		pxmin, pymin, pxmax, pymax := polygonBBox(piece)
+		xmin, ymin = math.Min(xmin, pxmin), math.Min(ymin, pymin)
+		xmax, ymax = math.Max(xmax, pxmax), math.Max(ymax, pymax)
+	}
+
+	for _, ti := range tree.queryXY(xmin, ymin, xmax, ymax) {
+		face := m.faces[ti]
+		v0, v1, v2 := m.vertices[face[0]], m.vertices[face[1]], m.vertices[face[2]]
+		for _, piece := range pieces {
+			clipped := clipPolygon([]point{v0, v1, v2}, piece)
+			if len(clipped) < 3 {
+				continue
+			}
+			for i := range clipped {
+				wa, wb, wc := barycentric2D(clipped[i], v0, v1, v2)
+				clipped[i].z = float32(wa*float64(v0.z) + wb*float64(v1.z) + wc*float64(v2.z))
+			}
+			for k := 1; k < len(clipped)-1; k++ {
+				newFace := [3]int32{
+					vertexIndex(clipped[0]),
+					vertexIndex(clipped[k]),
+					vertexIndex(clipped[k+1]),
+				}
+				if newFace[0] == newFace[1] || newFace[1] == newFace[2] || newFace[0] == newFace[2] {
+					continue
+				}
+				out.faces = append(out.faces, newFace)
+			}
+		}
+	}
+	return out
+}
+
 func expect(scanner *bufio.Scanner, expected string) {
 	scanner.Scan()
 	str := scanner.Text()
@@ -137,7 +947,7 @@ func readAscii(r *bufio.Reader) polygons {
 	}
 	expect(scanner, "solid")
 	scanner.Scan()
-	shapeName := scanner.Text()
+	shapeName = scanner.Text()
 	if moduleName == "" {
 		moduleName = shapeName
 	}
@@ -237,12 +1047,8 @@ func pointToOpenScad(pt point) string {
 	return fmt.Sprintf("[%s,%s,%s]", ftos(pt.x), ftos(pt.y), ftos(pt.z))
 }
 
-func facesToOpenScad(start, len int) string {
-	var f []string
-	for i := 0; i < len; i++ {
-		f = append(f, fmt.Sprintf("%d", start+i))
-	}
-	return "[" + strings.Join(f, ",") + "]"
+func faceToOpenScad(face [3]int32) string {
+	return fmt.Sprintf("[%d,%d,%d]", face[0], face[1], face[2])
 }
 
 func combineStrings(strings []string, count int, separator string) []string {
@@ -268,18 +1074,16 @@ func combineStrings(strings []string, count int, separator string) []string {
 	return lines
 }
 
-func writeOpenScad(w *bufio.Writer, polygons polygons) {
+func writeOpenScad(w *bufio.Writer, m mesh) {
 	var (
 		points []string
 		faces  []string
 	)
-	ofs := 0
-	for _, p := range polygons {
-		for _, v := range p.vertices {
-			points = append(points, pointToOpenScad(v))
-		}
-		faces = append(faces, facesToOpenScad(ofs, len(p.vertices)))
-		ofs = ofs + len(p.vertices)
+	for _, v := range m.vertices {
+		points = append(points, pointToOpenScad(v))
+	}
+	for _, f := range m.faces {
+		faces = append(faces, faceToOpenScad(f))
 	}
 
 	fmt.Fprintf(w, "module %s() {\n", moduleName)
@@ -300,6 +1104,74 @@ func writeOpenScad(w *bufio.Writer, polygons polygons) {
 	w.Flush()
 }
 
+func parseZList(s string) []float32 {
+	var zs []float32
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 32)
+		if err != nil {
+			log.Fatalf("Can't parse z value %q: %s", part, err)
+		}
+		zs = append(zs, float32(v))
+	}
+	return zs
+}
+
+func point2dToOpenScad(p point) string {
+	return fmt.Sprintf("[%s,%s]", ftos(p.x), ftos(p.y))
+}
+
+// writeContoursOpenScad slices m at each consecutive pair of zs and emits
+// each cross-section as a linear_extrude'd polygon, stacked on top of
+// each other.
+func writeContoursOpenScad(w *bufio.Writer, m mesh, zs []float32, weld float64, tree *strTree) {
+	fmt.Fprintf(w, "module %s() {\n", moduleName)
+	for i := 0; i < len(zs)-1; i++ {
+		level := zs[i]
+		height := zs[i+1] - zs[i]
+		rings := sliceMesh(m, level, weld, tree)
+		if len(rings) == 0 {
+			log.Printf("No contours found at z=%s, skipping layer", ftos(level))
+			continue
+		}
+
+		var points []string
+		var paths []string
+		ofs := 0
+		holes := 0
+		for _, ring := range rings {
+			var path []string
+			for _, p := range ring {
+				points = append(points, point2dToOpenScad(p))
+				path = append(path, fmt.Sprintf("%d", ofs))
+				ofs++
+			}
+			// For a correctly wound mesh, the ring winding sliceMesh/stitchRings
+			// produce puts outer boundaries at a negative signed area and holes
+			// at a positive one - the opposite of the naive polygon-with-holes
+			// convention, so the hole check below is intentionally inverted.
+			if signedArea(ring) > 0 {
+				holes++
+			}
+			paths = append(paths, "["+strings.Join(path, ",")+"]")
+		}
+		log.Printf("z=%s: %d ring(s), %d hole(s)", ftos(level), len(rings), holes)
+
+		fmt.Fprintf(w, "  translate([0,0,%s])\n", ftos(level))
+		fmt.Fprintf(w, "  linear_extrude(height=%s)\n", ftos(height))
+		fmt.Fprintf(w, "  polygon(\n")
+		fmt.Fprintf(w, "    points=[%s],\n", strings.Join(points, ", "))
+		fmt.Fprintf(w, "    paths=[%s]\n", strings.Join(paths, ", "))
+		fmt.Fprintf(w, "  );\n")
+	}
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "%s();\n", moduleName)
+	w.Flush()
+}
+
 func postProcess(polygons polygons) {
 	if !*centerFlag {
 		return
@@ -318,33 +1190,234 @@ func postProcess(polygons polygons) {
 	}
 }
 
+const repairAreaEpsilon = 1e-9
+
+// triangleArea returns the area of the 3D triangle (v0,v1,v2), via the
+// magnitude of the cross product of two of its edges.
+func triangleArea(v0, v1, v2 point) float64 {
+	ux, uy, uz := float64(v1.x-v0.x), float64(v1.y-v0.y), float64(v1.z-v0.z)
+	vx, vy, vz := float64(v2.x-v0.x), float64(v2.y-v0.y), float64(v2.z-v0.z)
+	cx := uy*vz - uz*vy
+	cy := uz*vx - ux*vz
+	cz := ux*vy - uy*vx
+	return math.Sqrt(cx*cx+cy*cy+cz*cz) / 2
+}
+
+func faceHasDirectedEdge(f [3]int32, a, b int32) bool {
+	for i := 0; i < 3; i++ {
+		j := (i + 1) % 3
+		if f[i] == a && f[j] == b {
+			return true
+		}
+	}
+	return false
+}
+
+// repairMesh is the mesh-level counterpart of postProcess, run once the
+// mesh has been welded so edges can be identified by shared vertex
+// indices. It (a) drops degenerate facets, (b) reports boundary and
+// non-manifold edges, and (c) flood-fills a consistent winding from a
+// seed facet. OpenSCAD's polyhedron/CGAL backend produces errors on
+// inconsistently wound or non-manifold input, which is common in binary
+// STLs whose header-declared normal disagrees with the vertex order.
+func repairMesh(m mesh) mesh {
+	clean := mesh{vertices: m.vertices}
+	for _, f := range m.faces {
+		if f[0] == f[1] || f[1] == f[2] || f[0] == f[2] {
+			continue
+		}
+		if triangleArea(m.vertices[f[0]], m.vertices[f[1]], m.vertices[f[2]]) < repairAreaEpsilon {
+			continue
+		}
+		clean.faces = append(clean.faces, f)
+	}
+	if dropped := len(m.faces) - len(clean.faces); dropped > 0 {
+		log.Printf("Repair: dropped %d degenerate facet(s)", dropped)
+	}
+
+	type edgeKey struct{ a, b int32 }
+	canonical := func(a, b int32) edgeKey {
+		if a > b {
+			a, b = b, a
+		}
+		return edgeKey{a, b}
+	}
+	facesByEdge := make(map[edgeKey][]int)
+	for fi, f := range clean.faces {
+		for i := 0; i < 3; i++ {
+			j := (i + 1) % 3
+			k := canonical(f[i], f[j])
+			facesByEdge[k] = append(facesByEdge[k], fi)
+		}
+	}
+
+	boundary, nonManifold := 0, 0
+	adjacency := make(map[int][]edgeKey)
+	for k, fs := range facesByEdge {
+		switch len(fs) {
+		case 1:
+			boundary++
+		case 2:
+			adjacency[fs[0]] = append(adjacency[fs[0]], k)
+			adjacency[fs[1]] = append(adjacency[fs[1]], k)
+		default:
+			nonManifold++
+			log.Printf("Repair: non-manifold edge %d-%d shared by %d facet(s)", k.a, k.b, len(fs))
+		}
+	}
+	if boundary > 0 {
+		log.Printf("Repair: %d boundary edge(s) found", boundary)
+	}
+	if nonManifold > 0 {
+		log.Printf("Repair: %d non-manifold edge(s) found", nonManifold)
+	}
+
+	// Flood-fill a consistent winding across the manifold part of the
+	// mesh: two facets sharing an edge should traverse it in opposite
+	// directions; if they agree, one of them is flipped.
+	visited := make([]bool, len(clean.faces))
+	flipped := 0
+	for seed := range clean.faces {
+		if visited[seed] {
+			continue
+		}
+		visited[seed] = true
+		queue := []int{seed}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			for _, edge := range adjacency[cur] {
+				for _, nb := range facesByEdge[edge] {
+					if nb == cur || visited[nb] {
+						continue
+					}
+					visited[nb] = true
+					curForward := faceHasDirectedEdge(clean.faces[cur], edge.a, edge.b)
+					nbForward := faceHasDirectedEdge(clean.faces[nb], edge.a, edge.b)
+					if curForward == nbForward {
+						clean.faces[nb][0], clean.faces[nb][1] = clean.faces[nb][1], clean.faces[nb][0]
+						flipped++
+					}
+					queue = append(queue, nb)
+				}
+			}
+		}
+	}
+	if flipped > 0 {
+		log.Printf("Repair: flipped %d facet(s) to make winding consistent", flipped)
+	}
+
+	return clean
+}
+
 func init() {
 	flag.Parse()
 	moduleName = *moduleNameFlag
 }
 
 func main() {
-	input := bufio.NewReader(openInput())
 	output := bufio.NewWriter(openOutput())
 
-	var polygons polygons
-	// Read first few bytes to determine ascii or binary
-	buf, _ := input.Peek(6)
-	if string(buf) == "solid " {
-		log.Print("Reading ASCII file")
-		polygons = readAscii(input)
-	} else {
-		log.Print("Reading Binary file")
-		polygons = readBinary(input)
+	var wantCache meshCacheHeader
+	wantCache.weld = *weldFlag
+	wantCache.center = *centerFlag
+	if *inputFilenameFlag != "" {
+		if fi, err := os.Stat(*inputFilenameFlag); err == nil {
+			wantCache.sourceSize = fi.Size()
+			wantCache.sourceModTime = fi.ModTime().UnixNano()
+		}
+	}
+
+	var m mesh
+	if *cacheFlag != "" {
+		if _, err := os.Stat(*cacheFlag); err == nil {
+			if cached, cachedHeader, ok := readMeshCache(*cacheFlag, wantCache); ok {
+				log.Printf("Loading mesh from cache %q", *cacheFlag)
+				m = cached
+				if moduleName == "" {
+					moduleName = cachedHeader.shapeName
+				}
+			}
+		}
+	}
+
+	if m.vertices == nil {
+		input := bufio.NewReader(openInput())
+
+		// Transparently decompress gzipped input before sniffing it.
+		if magic, _ := input.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			log.Print("Detected gzip-compressed input")
+			gz, err := gzip.NewReader(input)
+			if err != nil {
+				log.Fatalf("Can't decompress input: %s", err)
+			}
+			input = bufio.NewReader(gz)
+		}
+
+		var polygons polygons
+		// Read first few bytes to determine ascii or binary
+		buf, _ := input.Peek(6)
+		if string(buf) == "solid " {
+			log.Print("Reading ASCII file")
+			polygons = readAscii(input)
+		} else {
+			log.Print("Reading Binary file")
+			polygons = readBinary(input)
+		}
+		log.Printf("# of facets: %d", len(polygons))
+
+		postProcess(polygons)
+
+		m = buildMesh(polygons, *weldFlag)
+		log.Printf("# of unique vertices: %d (welded from %d)", len(m.vertices), 3*len(polygons))
+
+		if *cacheFlag != "" {
+			log.Printf("Writing mesh cache to %q", *cacheFlag)
+			wantCache.shapeName = shapeName
+			writeMeshCache(*cacheFlag, m, wantCache)
+		}
+	}
+
+	if *repairFlag {
+		m = repairMesh(m)
+	}
+
+	if *clipFlag != "" || *bboxFlag != "" {
+		tree := buildSTRTree(m)
+
+		if *clipFlag != "" {
+			clipPoly := readClipPolygon(*clipFlag)
+			pieces := clipPieces(clipPoly)
+			if len(pieces) > 1 {
+				log.Printf("Clip polygon %q is non-convex, decomposed into %d convex pieces", *clipFlag, len(pieces))
+			}
+			before := len(m.faces)
+			m = clipMesh(m, pieces, *weldFlag, tree)
+			log.Printf("Clipped mesh to %q: %d -> %d triangles", *clipFlag, before, len(m.faces))
+			tree = buildSTRTree(m)
+		}
+
+		if *bboxFlag != "" {
+			xmin, ymin, xmax, ymax := parseBBox(*bboxFlag)
+			before := len(m.faces)
+			m = exportBBox(m, tree, xmin, ymin, xmax, ymax)
+			log.Printf("Exported bbox %q: %d -> %d triangles", *bboxFlag, before, len(m.faces))
+		}
 	}
-	log.Printf("# of facets: %d", len(polygons))
 
 	if moduleName == "" {
 		moduleName = "shape"
 	}
 	log.Printf("Using module name %q", moduleName)
 
-	postProcess(polygons)
+	if *modeFlag == "contours" {
+		zs := parseZList(*zFlag)
+		if len(zs) < 2 {
+			log.Fatalf("-mode=contours requires at least two -z values")
+		}
+		writeContoursOpenScad(output, m, zs, *weldFlag, buildSTRTree(m))
+		return
+	}
 
-	writeOpenScad(output, polygons)
+	writeOpenScad(output, m)
 }